@@ -0,0 +1,83 @@
+package visitercontrol
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+//TestSetMaxKeysIsGlobalHardCap 即便分片数量(256)远大于SetMaxKeys设置的上限，
+//总的存活key数量也不应该超过这个上限，不能出现"256个分片各留1个，一共256个"这种远超预期的情况
+func TestSetMaxKeysIsGlobalHardCap(t *testing.T) {
+	vc := NewSharded(time.Hour, time.Minute*30, 5, 100, 256)
+	vc.SetMaxKeys(3)
+
+	for i := 0; i < 50; i++ {
+		vc.AllowVisit(fmt.Sprintf("visitor-%d", i))
+	}
+
+	count := 0
+	for _, s := range vc.shards {
+		s.mu.RLock()
+		count += len(s.records)
+		s.mu.RUnlock()
+	}
+	if count > 3 {
+		t.Fatalf("expected at most 3 tracked keys, got %d", count)
+	}
+}
+
+//TestSetMaxKeysIsGlobalHardCapUnderConcurrency 和TestSetMaxKeysIsGlobalHardCap验证的是同一件事，
+//但改用大量并发新key去触发AllowVisit，这样才能真正暴露"先判断keyCount<maxKeys、再腾出空间、最后才插入"
+//这种分成三步走的写法里的竞态：多个协程可能在判断那一步都看到名额充足，于是一起插入，
+//导致keyCount远超过maxKeys
+func TestSetMaxKeysIsGlobalHardCapUnderConcurrency(t *testing.T) {
+	vc := NewSharded(time.Hour, time.Minute*30, 5, 1000, 256)
+	vc.SetMaxKeys(10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vc.AllowVisit(fmt.Sprintf("concurrent-visitor-%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	count := 0
+	for _, s := range vc.shards {
+		s.mu.RLock()
+		count += len(s.records)
+		s.mu.RUnlock()
+	}
+	if count > 10 {
+		t.Fatalf("expected at most 10 tracked keys under concurrent inserts, got %d", count)
+	}
+}
+
+//TestOnEvictedCanCallBackWithoutDeadlock OnEvicted回调必须在分片锁释放之后才被调用，
+//否则回调里对同一个Visitercontrol发起的调用(哪怕落在同一个分片上)会因为RWMutex不可重入而死锁。
+//在maxKeys=1这种极限配置下，回调里重新抢占的那个key有可能马上又被外层的预留逻辑淘汰掉，
+//从而让回调不止触发一次，所以这里只关心"会不会死锁"，用sync.Once兼容回调被多次触发的情况
+func TestOnEvictedCanCallBackWithoutDeadlock(t *testing.T) {
+	vc := NewSharded(time.Hour, time.Minute*30, 5, 100, 4)
+	vc.SetMaxKeys(1)
+
+	done := make(chan struct{})
+	var once sync.Once
+	vc.OnEvicted(func(key interface{}) {
+		vc.AllowVisit("reentrant-from-callback")
+		once.Do(func() { close(done) })
+	})
+
+	vc.AllowVisit("first")
+	vc.AllowVisit("second") //触发淘汰，进而同步调用OnEvicted回调
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("OnEvicted callback calling back into the limiter deadlocked")
+	}
+}
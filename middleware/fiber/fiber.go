@@ -0,0 +1,24 @@
+//Package fiber 把visitercontrol适配成fiber.Handler形式的限流中间件
+package fiber
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	visitercontrol "github.com/comcn1949/visitercontrol"
+	"github.com/comcn1949/visitercontrol/middleware"
+)
+
+//Handler 返回一个fiber.Handler形式的限流中间件，用keyFn从fiber.Ctx中提取限流key，
+//调用ctl.AllowVisit判断是否放行，被拒绝时写出标准限流响应头后调用onBlock
+func Handler(ctl *visitercontrol.Visitercontrol, keyFn func(*fiber.Ctx) interface{}, onBlock fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := keyFn(c)
+		if ctl.AllowVisit(key) {
+			return c.Next()
+		}
+		for name, value := range middleware.RateLimitHeaders(ctl, key) {
+			c.Set(name, value)
+		}
+		return onBlock(c)
+	}
+}
@@ -0,0 +1,26 @@
+//Package gin 把visitercontrol适配成gin.HandlerFunc形式的限流中间件
+package gin
+
+import (
+	"github.com/gin-gonic/gin"
+
+	visitercontrol "github.com/comcn1949/visitercontrol"
+	"github.com/comcn1949/visitercontrol/middleware"
+)
+
+//Handler 返回一个gin.HandlerFunc形式的限流中间件，用keyFn从gin.Context中提取限流key，
+//调用ctl.AllowVisit判断是否放行，被拒绝时写出标准限流响应头后调用onBlock并终止后续处理
+func Handler(ctl *visitercontrol.Visitercontrol, keyFn func(*gin.Context) interface{}, onBlock gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := keyFn(c)
+		if ctl.AllowVisit(key) {
+			c.Next()
+			return
+		}
+		for name, value := range middleware.RateLimitHeaders(ctl, key) {
+			c.Header(name, value)
+		}
+		onBlock(c)
+		c.Abort()
+	}
+}
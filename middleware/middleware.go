@@ -0,0 +1,129 @@
+//Package middleware 把visitercontrol包装成标准net/http中间件，
+//并为gin、fiber提供对应适配器(见middleware/gin、middleware/fiber子包)，
+//是visitercontrol用作Web应用限流器时最常见的接入方式
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	visitercontrol "github.com/comcn1949/visitercontrol"
+)
+
+//Handler 返回一个标准net/http中间件：用keyFn从请求中提取限流key，
+//调用ctl.AllowVisit判断是否放行；被拒绝时先写出标准限流响应头，再调用onBlock处理该请求
+func Handler(ctl *visitercontrol.Visitercontrol, keyFn func(*http.Request) interface{}, onBlock http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keyFn(r)
+			if ctl.AllowVisit(key) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for name, value := range RateLimitHeaders(ctl, key) {
+				w.Header().Set(name, value)
+			}
+			onBlock(w, r)
+		})
+	}
+}
+
+//RateLimitHeaders 计算被拒绝请求应当携带的标准限流响应头：
+//X-RateLimit-Limit/X-RateLimit-Remaining取所有规则中剩余次数最少(即本次真正导致拒绝)的那条规则，
+//X-RateLimit-Reset/Retry-After取自ctl.NextResetAt，即所有规则重新放行所需等待到的时刻。
+//返回map而不是直接写入http.ResponseWriter，方便gin、fiber等非net/http框架的适配器复用同一份逻辑
+func RateLimitHeaders(ctl *visitercontrol.Visitercontrol, key interface{}) map[string]string {
+	headers := make(map[string]string, 4)
+	rules := ctl.Rules()
+	remaining := ctl.RemainingVisits(key)
+	if len(rules) == 0 || len(rules) != len(remaining) {
+		return headers
+	}
+	tightest := 0
+	for i := 1; i < len(remaining); i++ {
+		if remaining[i] < remaining[tightest] {
+			tightest = i
+		}
+	}
+	headers["X-RateLimit-Limit"] = strconv.Itoa(rules[tightest].MaxVisits())
+	headers["X-RateLimit-Remaining"] = strconv.Itoa(remaining[tightest])
+
+	resetAt := ctl.NextResetAt(key)
+	if resetAt.IsZero() {
+		return headers
+	}
+	headers["X-RateLimit-Reset"] = strconv.FormatInt(resetAt.Unix(), 10)
+	retryAfter := int(time.Until(resetAt).Seconds())
+	if retryAfter < 0 {
+		retryAfter = 0
+	}
+	headers["Retry-After"] = strconv.Itoa(retryAfter)
+	return headers
+}
+
+//ByIP 返回一个keyFn，以客户端真实IP作为限流key。
+//trustedProxies是反向代理(如Nginx、负载均衡)的IP列表，只有请求直接来源地址在该列表中时，
+//才会信任X-Forwarded-For/X-Real-IP头，避免客户端直接伪造这两个头绕过限流；不传trustedProxies则始终信任
+func ByIP(trustedProxies ...string) func(*http.Request) interface{} {
+	trusted := make(map[string]bool, len(trustedProxies))
+	for _, ip := range trustedProxies {
+		trusted[ip] = true
+	}
+	return func(r *http.Request) interface{} {
+		remoteIP := remoteAddrIP(r.RemoteAddr)
+		if len(trusted) == 0 || trusted[remoteIP] {
+			if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+				return strings.TrimSpace(strings.Split(xff, ",")[0])
+			}
+			if xri := r.Header.Get("X-Real-IP"); xri != "" {
+				return xri
+			}
+		}
+		return remoteIP
+	}
+}
+
+//remoteAddrIP 从形如"1.2.3.4:1234"的RemoteAddr中剥离出IP部分
+func remoteAddrIP(remoteAddr string) string {
+	if i := strings.LastIndex(remoteAddr, ":"); i != -1 {
+		return remoteAddr[:i]
+	}
+	return remoteAddr
+}
+
+//ByHeader 返回一个keyFn，以指定请求头(如Authorization)的值作为限流key
+func ByHeader(name string) func(*http.Request) interface{} {
+	return func(r *http.Request) interface{} {
+		return r.Header.Get(name)
+	}
+}
+
+//Compose 将多个keyFn的结果拼接成一个组合key，用于实现例如"同一IP+同一账号"这类复合维度的限流
+func Compose(fns ...func(*http.Request) interface{}) func(*http.Request) interface{} {
+	return func(r *http.Request) interface{} {
+		var b strings.Builder
+		for i, fn := range fns {
+			if i > 0 {
+				b.WriteByte('|')
+			}
+			b.WriteString(toKeyString(fn(r)))
+		}
+		return b.String()
+	}
+}
+
+//toKeyString 把keyFn的返回值统一转换为字符串，便于Compose拼接
+func toKeyString(v interface{}) string {
+	switch k := v.(type) {
+	case string:
+		return k
+	case int64:
+		return strconv.FormatInt(k, 10)
+	case int:
+		return strconv.Itoa(k)
+	default:
+		return ""
+	}
+}
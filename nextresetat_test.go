@@ -0,0 +1,30 @@
+package visitercontrol
+
+import (
+	"testing"
+	"time"
+)
+
+//TestNextResetAtAgreesWithRemainingOnExpiredButUnswept 队列里堆着一条已经过期、但还没被deleteExpiredOnce
+//清理掉的记录时，NextResetAt和RemainingVisits对"该规则是否仍被占满"的判断必须一致，
+//否则RemainingVisits已经认为还有剩余额度，NextResetAt却仍然返回一个早已过去的、没有意义的重置时间
+func TestNextResetAtAgreesWithRemainingOnExpiredButUnswept(t *testing.T) {
+	//直接用newVisitercontrol构造，不启动后台清理协程，
+	//这样才能稳定复现"已经过期、但还没被deleteExpiredOnce清理掉"的场景，不受清理周期影响
+	vc := newVisitercontrol(time.Millisecond*50, time.Millisecond*50, 1, 10, defaultShardCount)
+
+	if !vc.AllowVisit("alice") {
+		t.Fatalf("expected first visit to be allowed")
+	}
+
+	//等待这唯一一条访问记录过期，但不触发deleteExpiredOnce(没有启动后台清理协程)
+	time.Sleep(time.Millisecond * 100)
+
+	remaining := vc.RemainingVisits("alice")
+	if len(remaining) != 1 || remaining[0] != 1 {
+		t.Fatalf("expected 1 remaining visit once the only record has expired, got %v", remaining)
+	}
+	if got := vc.NextResetAt("alice"); !got.IsZero() {
+		t.Fatalf("expected NextResetAt to agree with RemainingVisits and return zero time, got %v", got)
+	}
+}
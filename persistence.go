@@ -0,0 +1,318 @@
+package visitercontrol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+//快照文件格式：
+//魔数(4字节"VCDB") + 版本号(1字节) + defaultExpiration(int64纳秒) + maxVisitsNum(int64) + 保存时刻now(int64纳秒)
+//+ 规则数量(uint32) + 每条规则: window(int64纳秒) + maxVisitsNum(int64)
+//之后为若干条记录，每条记录：keyType(1字节) + key内容 + 规则数量(uint32) + 每条规则: 队列长度(uint32) + 对应数量的int64过期时间戳
+const (
+	discMagic   = "VCDB"
+	discVersion = uint8(2)
+
+	keyTypeString = uint8(0)
+	keyTypeInt64  = uint8(1)
+	keyTypeInt    = uint8(2)
+)
+
+/*
+LoadingAndAutoSaveToDisc 让访问记录具备持久化能力：
+调用时先从path读取此前保存的快照并恢复各分片上的访问记录，
+随后启动一个后台协程，每隔interval把当前状态完整写入磁盘一次(先写入path.tmp，再rename为path，保证写入过程中断电/崩溃不会损坏原文件)。
+若path文件不存在，则视为首次运行，不会返回错误。
+*/
+func (this *Visitercontrol) LoadingAndAutoSaveToDisc(path string, interval time.Duration) error {
+	if err := this.LoadFromDisc(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			this.SaveToDisc(path)
+		}
+	}()
+	return nil
+}
+
+//SaveToDisc 将当前访问记录完整写入path，原子替换(先写临时文件再rename)
+func (this *Visitercontrol) SaveToDisc(path string) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if _, err := w.WriteString(discMagic); err != nil {
+		f.Close()
+		return err
+	}
+	binary.Write(w, binary.LittleEndian, discVersion)
+	binary.Write(w, binary.LittleEndian, int64(this.defaultExpiration))
+	binary.Write(w, binary.LittleEndian, int64(this.maxVisitsNum))
+	binary.Write(w, binary.LittleEndian, time.Now().UnixNano())
+	//把当前规则集合也写入头部，加载时据此校验规则配置是否发生了变化，
+	//避免重启后规则(尤其是maxVisitsNum)变了，却仍然沿用快照里按旧规则算出的队列容量
+	writeRules(w, this.rules)
+
+	//逐个分片加读锁写出，不需要冻结整张表
+	for _, s := range this.shards {
+		s.mu.RLock()
+		for k, record := range s.records {
+			if record.isEmpty() {
+				continue
+			}
+			//不支持持久化的key类型直接跳过
+			if !writeKey(w, k) {
+				continue
+			}
+			binary.Write(w, binary.LittleEndian, uint32(len(record.queues)))
+			for _, q := range record.queues {
+				timestamps := q.snapshot()
+				binary.Write(w, binary.LittleEndian, uint32(len(timestamps)))
+				for _, ts := range timestamps {
+					binary.Write(w, binary.LittleEndian, ts)
+				}
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+//LoadFromDisc 从path读取快照并恢复访问记录，已经过期的时间戳在加载时直接丢弃，
+//丢弃后某条记录的所有规则队列都为空时，该记录也不会被恢复
+func (this *Visitercontrol) LoadFromDisc(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(discMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != discMagic {
+		return errors.New("visitercontrol: 快照文件格式不正确")
+	}
+	var version uint8
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return err
+	}
+	if version != discVersion {
+		return errors.New("visitercontrol: 不支持的快照文件版本")
+	}
+	//仅用于头部完整性校验，当前恢复逻辑以运行中的defaultExpiration/maxVisitsNum/rules为准
+	var savedExpiration, savedMaxVisitsNum, savedNow int64
+	if err := binary.Read(r, binary.LittleEndian, &savedExpiration); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &savedMaxVisitsNum); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &savedNow); err != nil {
+		return err
+	}
+	savedRules, err := readRules(r)
+	if err != nil {
+		return err
+	}
+	//规则配置是全局的，不是per-record的：只要保存时的规则(数量、window、maxVisitsNum)与当前运行中的不完全一致，
+	//快照里按旧规则计算出的队列容量(见下方maxSize)对现在的配置来说就是错的，整份快照都不可信，直接拒绝加载。
+	//只校验规则数量(numQueues)、放过window/maxVisitsNum变化，会让例如maxVisitsNum从100改成5之后，
+	//恢复出来的记录永远按maxSize=100计算剩余次数，RemainingVisits会一直报负数
+	if !rulesEqual(savedRules, this.rules) {
+		return errors.New("visitercontrol: 快照中保存的规则配置与当前配置不一致")
+	}
+
+	now := time.Now().UnixNano()
+	for {
+		keyType, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key, err := readKey(r, keyType)
+		if err != nil {
+			return err
+		}
+		var numQueues uint32
+		if err := binary.Read(r, binary.LittleEndian, &numQueues); err != nil {
+			return err
+		}
+		queues := make([]*circleQueueInt64, numQueues)
+		for i := range queues {
+			var qlen uint32
+			if err := binary.Read(r, binary.LittleEndian, &qlen); err != nil {
+				return err
+			}
+			timestamps := make([]int64, 0, qlen)
+			for j := uint32(0); j < qlen; j++ {
+				var ts int64
+				if err := binary.Read(r, binary.LittleEndian, &ts); err != nil {
+					return err
+				}
+				//丢弃已经过期的访问记录
+				if ts < now {
+					continue
+				}
+				timestamps = append(timestamps, ts)
+			}
+			maxSize := len(timestamps)
+			if i < len(this.rules) && this.rules[i].maxVisitsNum > maxSize {
+				maxSize = this.rules[i].maxVisitsNum
+			}
+			if maxSize == 0 {
+				maxSize = 1
+			}
+			q := newCircleQueueInt64(maxSize)
+			for _, ts := range timestamps {
+				q.Push(ts)
+			}
+			queues[i] = q
+		}
+		//快照里保存的规则数量与当前运行中配置的规则数量对不上(例如重启时没有重新执行保存时的那些AddRule调用)，
+		//直接信任numQueues会让record.queues比this.rules长，后续allow()里的rules[i]会越界panic，因此整条丢弃
+		if int(numQueues) != len(this.rules) {
+			continue
+		}
+		if queuesAllEmpty(queues) {
+			continue
+		}
+		this.storeLoadedRecord(key, &visitorRecord{queues: queues})
+	}
+	return nil
+}
+
+//queuesAllEmpty 判断一组恢复出来的队列是否全部为空
+func queuesAllEmpty(queues []*circleQueueInt64) bool {
+	for _, q := range queues {
+		if q.UsedSize() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//storeLoadedRecord 把从快照恢复出来的记录放回key所属的分片
+func (this *Visitercontrol) storeLoadedRecord(key interface{}, record *visitorRecord) {
+	s := this.shardFor(key)
+	s.mu.Lock()
+	_, exist := s.records[key]
+	s.records[key] = record
+	s.touch(key)
+	s.mu.Unlock()
+	if !exist {
+		atomic.AddInt64(&this.keyCount, 1)
+	}
+}
+
+//writeRules 写入规则数量及每条规则的window/maxVisitsNum
+func writeRules(w io.Writer, rules []Rule) {
+	binary.Write(w, binary.LittleEndian, uint32(len(rules)))
+	for _, rule := range rules {
+		binary.Write(w, binary.LittleEndian, int64(rule.window))
+		binary.Write(w, binary.LittleEndian, int64(rule.maxVisitsNum))
+	}
+}
+
+//readRules 按writeRules写入时的格式读出规则列表
+func readRules(r io.Reader) ([]Rule, error) {
+	var ruleCount uint32
+	if err := binary.Read(r, binary.LittleEndian, &ruleCount); err != nil {
+		return nil, err
+	}
+	rules := make([]Rule, ruleCount)
+	for i := range rules {
+		var window, maxVisitsNum int64
+		if err := binary.Read(r, binary.LittleEndian, &window); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &maxVisitsNum); err != nil {
+			return nil, err
+		}
+		rules[i] = NewRule(time.Duration(window), int(maxVisitsNum))
+	}
+	return rules, nil
+}
+
+//rulesEqual 判断两份规则列表的数量及每条规则的window/maxVisitsNum是否完全一致，顺序也必须一致
+func rulesEqual(a, b []Rule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].window != b[i].window || a[i].maxVisitsNum != b[i].maxVisitsNum {
+			return false
+		}
+	}
+	return true
+}
+
+//writeKey 写入一个key，返回该key类型是否受支持(目前支持string/int64/int)
+func writeKey(w io.Writer, k interface{}) bool {
+	switch v := k.(type) {
+	case string:
+		binary.Write(w, binary.LittleEndian, keyTypeString)
+		binary.Write(w, binary.LittleEndian, uint32(len(v)))
+		io.WriteString(w, v)
+	case int64:
+		binary.Write(w, binary.LittleEndian, keyTypeInt64)
+		binary.Write(w, binary.LittleEndian, v)
+	case int:
+		binary.Write(w, binary.LittleEndian, keyTypeInt)
+		binary.Write(w, binary.LittleEndian, int64(v))
+	default:
+		return false
+	}
+	return true
+}
+
+//readKey 按keyType读出一个key
+func readKey(r *bufio.Reader, keyType uint8) (interface{}, error) {
+	switch keyType {
+	case keyTypeString:
+		var l uint32
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, l)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf), nil
+	case keyTypeInt64:
+		var v int64
+		if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case keyTypeInt:
+		var v int64
+		if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+			return nil, err
+		}
+		return int(v), nil
+	default:
+		return nil, errors.New("visitercontrol: 快照中存在未知的key类型")
+	}
+}
@@ -0,0 +1,78 @@
+package visitercontrol
+
+import (
+	"testing"
+	"time"
+)
+
+//TestSaveAndLoadFromDisc 验证save->restart->load的基本往返：重启后剩余次数应当延续保存时的状态
+func TestSaveAndLoadFromDisc(t *testing.T) {
+	path := t.TempDir() + "/snapshot.db"
+
+	vc := New(time.Minute, time.Millisecond*10, 5, 10)
+	if !vc.AllowVisit("alice") {
+		t.Fatalf("expected first visit to be allowed")
+	}
+	if !vc.AllowVisit("alice") {
+		t.Fatalf("expected second visit to be allowed")
+	}
+	if err := vc.SaveToDisc(path); err != nil {
+		t.Fatalf("SaveToDisc failed: %v", err)
+	}
+
+	restored := New(time.Minute, time.Millisecond*10, 5, 10)
+	if err := restored.LoadFromDisc(path); err != nil {
+		t.Fatalf("LoadFromDisc failed: %v", err)
+	}
+	remaining := restored.RemainingVisits("alice")
+	if len(remaining) != 1 || remaining[0] != 3 {
+		t.Fatalf("expected 3 remaining visits after restore, got %v", remaining)
+	}
+}
+
+//TestLoadFromDiscRuleCountMismatch 模拟保存时调用过AddRule，但重启后没有重新执行同样的AddRule，
+//规则数量对不上时应当拒绝整份快照，而不是panic，也不能让恢复出来的记录沿用旧的规则容量
+func TestLoadFromDiscRuleCountMismatch(t *testing.T) {
+	path := t.TempDir() + "/snapshot.db"
+
+	vc := New(time.Minute, time.Millisecond*10, 5, 10)
+	vc.AddRule(time.Hour, 50)
+	vc.AllowVisit("alice")
+	if err := vc.SaveToDisc(path); err != nil {
+		t.Fatalf("SaveToDisc failed: %v", err)
+	}
+
+	//重启时"忘记"重新调用AddRule，只剩1条规则，与快照里保存的2条对不上
+	restored := New(time.Minute, time.Millisecond*10, 5, 10)
+	if err := restored.LoadFromDisc(path); err == nil {
+		t.Fatalf("expected LoadFromDisc to reject a snapshot whose rule count no longer matches")
+	}
+	//不应panic，且由于规则配置不一致整份快照被拒绝，alice相当于全新访客
+	if !restored.AllowVisit("alice") {
+		t.Fatalf("expected alice to be treated as a fresh visitor after rejected restore")
+	}
+}
+
+//TestLoadFromDiscRuleLimitMismatch 规则数量没变，但其中一条规则的maxVisitsNum变了(运维调整了限流阈值)，
+//这种情况下快照里按旧阈值计算出的队列容量同样不可信，也应当拒绝整份快照
+func TestLoadFromDiscRuleLimitMismatch(t *testing.T) {
+	path := t.TempDir() + "/snapshot.db"
+
+	vc := New(time.Minute, time.Millisecond*10, 100, 10)
+	for i := 0; i < 60; i++ {
+		vc.AllowVisit("alice")
+	}
+	if err := vc.SaveToDisc(path); err != nil {
+		t.Fatalf("SaveToDisc failed: %v", err)
+	}
+
+	//重启时把maxVisitsNum从100调整为5，规则数量没变，但阈值变了
+	restored := New(time.Minute, time.Millisecond*10, 5, 10)
+	if err := restored.LoadFromDisc(path); err == nil {
+		t.Fatalf("expected LoadFromDisc to reject a snapshot whose rule limits no longer match")
+	}
+	remaining := restored.RemainingVisits("alice")
+	if len(remaining) != 1 || remaining[0] != 5 {
+		t.Fatalf("expected alice to be treated as a fresh visitor under the new limit, got %v", remaining)
+	}
+}
@@ -56,6 +56,29 @@ func (this *circleQueueInt64) UsedSize() int {
 	return (this.tail + this.maxSize - this.head) % this.maxSize
 }
 
+//Peek 返回head处的值，即最早一条尚未被清除的访问记录，不会修改head
+func (this *circleQueueInt64) Peek() (val int64, err error) {
+	if this.IsEmpty() {
+		return 0, errors.New("queue is empty")
+	}
+	return this.slice[this.head], nil
+}
+
+//ValidSize 非破坏性地统计队列中时间戳仍然大于now(即尚未过期)的记录数量，不会修改head，
+//与UsedSize的区别在于：两次DeleteExpired之间，UsedSize可能包含已经过期但还未被清理掉的记录
+func (this *circleQueueInt64) ValidSize(now int64) int {
+	size := this.UsedSize()
+	count := 0
+	index := this.head
+	for i := 0; i < size; i++ {
+		if this.slice[index] > now {
+			count++
+		}
+		index = (index + 1) % this.maxSize
+	}
+	return count
+}
+
 //判断队列中还有多少空间未使用
 func (this *circleQueueInt64) UnUsedSize() int {
 	return this.maxSize - 1 - this.UsedSize()
@@ -66,6 +89,18 @@ func (this *circleQueueInt64) Len() int {
 	return this.maxSize - 1
 }
 
+//snapshot 按从头到尾的顺序导出队列中当前所有的时间戳，不会修改head/tail，供持久化使用
+func (this *circleQueueInt64) snapshot() []int64 {
+	size := this.UsedSize()
+	result := make([]int64, size)
+	index := this.head
+	for i := 0; i < size; i++ {
+		result[i] = this.slice[index]
+		index = (index + 1) % this.maxSize
+	}
+	return result
+}
+
 //删除过期数据
 func (this *circleQueueInt64) DeleteExpired() {
 	now := time.Now().UnixNano()
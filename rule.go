@@ -0,0 +1,87 @@
+package visitercontrol
+
+import "time"
+
+//Rule 表示一条限流规则：在window时间窗口内最多允许访问maxVisitsNum次
+//例如 NewRule(time.Second, 10) 表示10次/秒，
+//多条规则组合使用即可实现"10次/秒 且 50次/30分钟 且 500次/天"这种复合限流
+type Rule struct {
+	window       time.Duration //时间窗口
+	maxVisitsNum int            //该时间窗口内最多允许访问的次数
+}
+
+//NewRule 创建一条限流规则
+func NewRule(window time.Duration, maxVisitsNum int) Rule {
+	return Rule{window: window, maxVisitsNum: maxVisitsNum}
+}
+
+//Window 该规则的时间窗口
+func (r Rule) Window() time.Duration {
+	return r.window
+}
+
+//MaxVisits 该规则时间窗口内最多允许访问的次数
+func (r Rule) MaxVisits() int {
+	return r.maxVisitsNum
+}
+
+//visitorRecord 某个访客在所有规则下的访问记录，每条规则对应一个环形队列
+type visitorRecord struct {
+	queues []*circleQueueInt64
+}
+
+//newVisitorRecord 根据当前规则集合创建一份空的访问记录
+func newVisitorRecord(rules []Rule) *visitorRecord {
+	var r visitorRecord
+	r.queues = make([]*circleQueueInt64, len(rules))
+	for i := range rules {
+		r.queues[i] = newCircleQueueInt64(rules[i].maxVisitsNum)
+	}
+	return &r
+}
+
+//allow 在所有规则的队列均未满时记录一次访问并返回true；
+//只要有一条规则已达上限就直接返回false，不会往其它规则的队列里记录，避免出现部分规则记录、部分规则拒绝的不一致状态。
+//判断是否已满之前先惰性清理一次过期数据，否则队列里堆满了尚未被deleteExpiredOnce清理的过期记录时，
+//IsFull会误判为已满，而此时remaining()(用ValidSize统计)却认为还有剩余，两者就会互相矛盾
+func (this *visitorRecord) allow(rules []Rule) bool {
+	for _, q := range this.queues {
+		q.DeleteExpired()
+		if q.IsFull() {
+			return false
+		}
+	}
+	now := time.Now()
+	for i, q := range this.queues {
+		q.Push(now.Add(rules[i].window).UnixNano())
+	}
+	return true
+}
+
+//remaining 返回每条规则下剩余可访问次数，统计时对每条队列做一次非破坏性的过期扫描，
+//避免把两次DeleteExpired之间已经过期但还未被清理掉的记录也算作"已使用"，导致剩余次数被低估
+func (this *visitorRecord) remaining(rules []Rule) []int {
+	now := time.Now().UnixNano()
+	result := make([]int, len(this.queues))
+	for i, q := range this.queues {
+		result[i] = rules[i].maxVisitsNum - q.ValidSize(now)
+	}
+	return result
+}
+
+//deleteExpired 清除每条规则队列中的过期数据
+func (this *visitorRecord) deleteExpired() {
+	for _, q := range this.queues {
+		q.DeleteExpired()
+	}
+}
+
+//isEmpty 所有规则队列是否都已经为空；已经过期但还未被清理掉的记录也算在内，需要先调用deleteExpired才能排除它们
+func (this *visitorRecord) isEmpty() bool {
+	for _, q := range this.queues {
+		if q.UsedSize() > 0 {
+			return false
+		}
+	}
+	return true
+}
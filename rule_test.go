@@ -0,0 +1,67 @@
+package visitercontrol
+
+import (
+	"testing"
+	"time"
+)
+
+//TestAllowVisitANDsCompositeRules 验证AddRule追加的多条规则确实是"且"的关系：
+//一条紧凑规则(2次/50毫秒)与一条宽松规则(5次/1小时)同时作用于同一个key时，
+//只有两条规则都未超限才允许访问，任意一条规则达到上限都应当拒绝
+func TestAllowVisitANDsCompositeRules(t *testing.T) {
+	vc := New(time.Millisecond*50, time.Millisecond*10, 2, 10)
+	vc.AddRule(time.Hour, 5)
+
+	if !vc.AllowVisit("alice") {
+		t.Fatalf("expected 1st visit to be allowed")
+	}
+	if !vc.AllowVisit("alice") {
+		t.Fatalf("expected 2nd visit to be allowed")
+	}
+	//紧凑规则(2次/50毫秒)已经用满，即便宽松规则还有剩余额度，也应当拒绝
+	if vc.AllowVisit("alice") {
+		t.Fatalf("expected 3rd visit within the same 50ms window to be rejected by the tight rule")
+	}
+
+	//等紧凑规则的窗口过去，紧凑规则重新放行，但宽松规则的计数会继续累加
+	time.Sleep(time.Millisecond * 100)
+	if !vc.AllowVisit("alice") {
+		t.Fatalf("expected visit after the tight window resets to be allowed")
+	}
+	if !vc.AllowVisit("alice") {
+		t.Fatalf("expected a 2nd visit in the new tight window to be allowed")
+	}
+	//此时宽松规则(5次/1小时)已经记录了第1、2次和这2次共4次，还差1次才用满；
+	//紧凑规则再次用满，应当再次被拒绝
+	if vc.AllowVisit("alice") {
+		t.Fatalf("expected 3rd visit within this tight window to be rejected by the tight rule again")
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	//到这里宽松规则下已经记录了4次访问，还剩1次额度
+	if !vc.AllowVisit("alice") {
+		t.Fatalf("expected the 5th overall visit to be allowed by the still-open loose rule")
+	}
+	//宽松规则(5次/1小时)已经用满，即便紧凑规则的窗口是空的，也应当拒绝
+	if vc.AllowVisit("alice") {
+		t.Fatalf("expected the 6th overall visit to be rejected by the now-exhausted loose rule")
+	}
+}
+
+//TestAllowRemainingAgreeOnExpiredButUnswept 队列里堆着一条已经过期、但还没被deleteExpiredOnce清理掉的记录时，
+//allow()和remaining()对"是否还有剩余额度"的判断必须一致，否则RemainingVisits会谎报还有额度，
+//紧接着的AllowVisit却仍然拒绝
+func TestAllowRemainingAgreeOnExpiredButUnswept(t *testing.T) {
+	rules := []Rule{NewRule(time.Minute, 1)}
+	record := newVisitorRecord(rules)
+	//直接往队列里塞入一条已经过期的时间戳，模拟deleteExpiredOnce还没来得及清理的场景
+	record.queues[0].Push(time.Now().Add(-time.Minute).UnixNano())
+
+	remaining := record.remaining(rules)
+	if remaining[0] != 1 {
+		t.Fatalf("expected 1 remaining visit once the only record has expired, got %v", remaining)
+	}
+	if !record.allow(rules) {
+		t.Fatalf("expected allow to agree with remaining and accept the visit")
+	}
+}
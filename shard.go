@@ -0,0 +1,73 @@
+package visitercontrol
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+//shard 是访问记录表的一个分片，每个分片拥有独立的map与读写锁，
+//不同分片之间互不影响，从而把原来全局sync.Map/RWMutex的竞争分散到各个分片上。
+//order/elems共同维护一份按最近访问排序的LRU链表，配合Visitercontrol.maxKeys这个全局硬上限使用，
+//由淘汰逻辑决定到底从哪个分片里取出最久未访问的key
+type shard struct {
+	mu      sync.RWMutex
+	records map[interface{}]*visitorRecord
+	order   *list.List
+	elems   map[interface{}]*list.Element
+}
+
+func newShard(sizeHint int) *shard {
+	var s shard
+	s.records = make(map[interface{}]*visitorRecord, sizeHint)
+	s.order = list.New()
+	s.elems = make(map[interface{}]*list.Element, sizeHint)
+	return &s
+}
+
+//touch 将key标记为最近访问，key不存在时在链表头部新建一项
+func (this *shard) touch(key interface{}) {
+	if elem, exist := this.elems[key]; exist {
+		this.order.MoveToFront(elem)
+		return
+	}
+	this.elems[key] = this.order.PushFront(key)
+}
+
+//forget 将key从LRU链表中移除，在key被删除(过期清理或被淘汰)时调用
+func (this *shard) forget(key interface{}) {
+	if elem, exist := this.elems[key]; exist {
+		this.order.Remove(elem)
+		delete(this.elems, key)
+	}
+}
+
+//isPowerOfTwo 分片数量必须是2的幂，这样才能用位运算(hash&mask)代替取模来定位分片
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+//hashKey 计算key的哈希值用于路由到具体分片：
+//int64(典型场景是IP)和int类型的key直接使用其值本身，字符串及其它类型的key使用FNV-64
+func hashKey(key interface{}) uint64 {
+	switch v := key.(type) {
+	case int64:
+		return uint64(v)
+	case int:
+		return uint64(v)
+	case string:
+		h := fnv.New64a()
+		h.Write([]byte(v))
+		return h.Sum64()
+	default:
+		h := fnv.New64a()
+		fmt.Fprint(h, v)
+		return h.Sum64()
+	}
+}
+
+//shardFor 根据key定位其所在的分片
+func (this *Visitercontrol) shardFor(key interface{}) *shard {
+	return this.shards[hashKey(key)&this.shardMask]
+}
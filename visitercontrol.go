@@ -1,21 +1,27 @@
 package visitercontrol
 
 import (
-	"github.com/yudeguang/hashset"
-	"sync"
+	"errors"
+	"sync/atomic"
 	"time"
 )
 
+//默认分片数量，必须是2的幂。分片越多，不同访客之间的锁竞争就越小，
+//但也会让AddRule等需要遍历所有分片的操作花费略多时间
+const defaultShardCount = 256
+
 //某单位时间内允许多少次访问
 type Visitercontrol struct {
-	defaultExpiration          time.Duration       //每条访问记录需要保存的时长，也就是过期时间
-	cleanupInterval            time.Duration       //多长时间需要执行一次清除操作
-	maxVisitsNum               int                 //每个用户在相应时间段内最多允许访问的次数
-	indexes                    sync.Map            //索引：key代表用户名或IP；value代表visitorRecords中的索引位置
-	maximumNumberOfOnlineUsers int                 //单位时间最大用户数量，建议选用一个稍大于实际值的值，以减少内存分配次数
-	visitorRecords             []*circleQueueInt64 //存储用户访问记录
-	notUsedVisitorRecordsIndex *hashset.SetInt     //对应visitorRecords中未使用的数据的索引位置
-	lock                       *sync.RWMutex       //并发锁
+	defaultExpiration          time.Duration //每条访问记录需要保存的时长，也就是过期时间
+	cleanupInterval            time.Duration //多长时间需要执行一次清除操作
+	maxVisitsNum               int           //每个用户在相应时间段内最多允许访问的次数
+	rules                      []Rule        //该限流器包含的所有规则，默认只有一条，可通过AddRule追加
+	maximumNumberOfOnlineUsers int           //单位时间最大用户数量，用于预估每个分片map的初始容量
+	shards                     []*shard      //按key哈希分片存储的访问记录，用于分散锁竞争
+	shardMask                  uint64        //len(shards)-1，用于将哈希值映射到具体分片
+	onEvicted                  func(key interface{}) //SetMaxKeys生效后某个key被LRU淘汰时的回调，可为nil
+	maxKeys                    int64         //SetMaxKeys配置的全局硬上限，0表示不限制；只通过atomic读写
+	keyCount                   int64         //当前存活的key总数，只通过atomic读写，用于和maxKeys比较以维持硬上限
 }
 
 /*
@@ -25,33 +31,58 @@ vc := visitercontrol.New(time.Minute*30, time.Second*5, 50, 1000)
 它表示:
 在30分钟内每个用户最多允许访问50次，系统每5秒针删除一次过期数据。
 并且我们预计同时在线用户数量大致在1000个左右。
+
+如果需要"10次/秒 且 50次/30分钟 且 500次/天"这种多条件组合限流，
+可在New之后通过AddRule追加更多规则，AllowVisit会在所有规则都未超限时才放行。
+
+New内部使用defaultShardCount个分片，如果需要根据实际并发量调整分片数量，请使用NewSharded。
 */
 func New(defaultExpiration, cleanupInterval time.Duration, maxVisitsNum, maximumNumberOfOnlineUsers int) *Visitercontrol {
-	this := new(defaultExpiration, cleanupInterval, maxVisitsNum, maximumNumberOfOnlineUsers)
+	return NewSharded(defaultExpiration, cleanupInterval, maxVisitsNum, maximumNumberOfOnlineUsers, defaultShardCount)
+}
+
+//NewSharded 与New类似，但可以指定分片数量shardCount(必须是2的幂)。
+//分片数量越多，不同访客之间的锁竞争越小，适合高并发写入场景；shardCount为1时退化为单把锁。
+func NewSharded(defaultExpiration, cleanupInterval time.Duration, maxVisitsNum, maximumNumberOfOnlineUsers, shardCount int) *Visitercontrol {
+	this := newVisitercontrol(defaultExpiration, cleanupInterval, maxVisitsNum, maximumNumberOfOnlineUsers, shardCount)
 	go this.deleteExpired()
 	return this
 }
 
-func new(defaultExpiration, cleanupInterval time.Duration, maxVisitsNum, maximumNumberOfOnlineUsers int) *Visitercontrol {
+func newVisitercontrol(defaultExpiration, cleanupInterval time.Duration, maxVisitsNum, maximumNumberOfOnlineUsers, shardCount int) *Visitercontrol {
 	if cleanupInterval > defaultExpiration {
 		panic("每次清除访问记录的时间间隔(cleanupInterval)必须小于待统计数据时间段(defaultExpiration)")
 	}
+	if !isPowerOfTwo(shardCount) {
+		panic("分片数量(shardCount)必须是2的幂")
+	}
 	var l Visitercontrol
-	var lock sync.RWMutex
 	l.defaultExpiration = defaultExpiration
 	l.cleanupInterval = cleanupInterval
 	l.maxVisitsNum = maxVisitsNum
+	l.rules = []Rule{NewRule(defaultExpiration, maxVisitsNum)}
 	l.maximumNumberOfOnlineUsers = maximumNumberOfOnlineUsers
-	l.notUsedVisitorRecordsIndex = hashset.NewInt()
-	l.lock = &lock
-	//初始化缓存池，减少内存分配，提升性能
-	l.visitorRecords = make([]*circleQueueInt64, l.maximumNumberOfOnlineUsers)
-	for i := range l.visitorRecords {
-		l.visitorRecords[i] = newCircleQueueInt64(l.maxVisitsNum)
-		l.notUsedVisitorRecordsIndex.Add(i)
+	l.shardMask = uint64(shardCount - 1)
+	sizeHint := maximumNumberOfOnlineUsers / shardCount
+	l.shards = make([]*shard, shardCount)
+	for i := range l.shards {
+		l.shards[i] = newShard(sizeHint)
 	}
 	return &l
+}
 
+//AddRule 为该限流器追加一条规则，例如再追加一条"500次/天"，
+//即可与New时传入的规则组合成"50次/30分钟 且 500次/天"。
+//AddRule只应在服务开始正式处理请求之前调用，不支持在AllowVisit并发调用期间动态追加规则。
+func (this *Visitercontrol) AddRule(window time.Duration, maxVisitsNum int) {
+	this.rules = append(this.rules, NewRule(window, maxVisitsNum))
+	for _, s := range this.shards {
+		s.mu.Lock()
+		for _, record := range s.records {
+			record.queues = append(record.queues, newCircleQueueInt64(maxVisitsNum))
+		}
+		s.mu.Unlock()
+	}
 }
 
 //是否允许访问,允许访问则往访问记录中加入一条访问记录
@@ -68,36 +99,188 @@ func (this *Visitercontrol) AllowVisitIP(ip string) bool {
 	return this.AllowVisit(ipInt64)
 }
 
+//RemainingVisits 返回该访客在每条规则下的剩余可访问次数，规则顺序与New/AddRule调用顺序一致
+func (this *Visitercontrol) RemainingVisits(key interface{}) []int {
+	s := this.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, exist := s.records[key]
+	if !exist {
+		remaining := make([]int, len(this.rules))
+		for i := range this.rules {
+			remaining[i] = this.rules[i].maxVisitsNum
+		}
+		return remaining
+	}
+	return record.remaining(this.rules)
+}
+
+//SetMaxKeys 限定整个限流器最多同时跟踪n个key，这是一个真正的全局硬上限：
+//新key到来且当前总key数已达到n时，会淘汰某个分片中最久未被访问的key(LRU)，即使它尚未过期，
+//优先淘汰新key所在的分片，只有该分片恰好没有可淘汰的key时才会依次尝试其它分片。
+//这样即便defaultExpiration设置得很长(如24小时)，内存占用也不会随着突发的海量不重复key无限增长。
+//设为0(默认)表示不做数量限制，完全依赖过期与deleteExpiredOnce回收内存。
+//例外：预留名额失败时(所有分片都没有可淘汰的key，或腾出空间的重试次数已用尽)，新key仍会被加入，总key数会超过n。
+func (this *Visitercontrol) SetMaxKeys(n int) {
+	atomic.StoreInt64(&this.maxKeys, int64(n))
+}
+
+//OnEvicted 注册一个回调，在SetMaxKeys生效后某个key因达到数量上限被LRU淘汰时调用。
+//回调在对应分片的锁已经释放之后才会被调用，因此可以安全地在回调里再次调用该Visitercontrol的方法(包括同一个key)，
+//但回调会同步阻塞触发淘汰的那次AllowVisit调用，不宜在其中做耗时操作
+func (this *Visitercontrol) OnEvicted(fn func(key interface{})) {
+	this.onEvicted = fn
+}
+
+//Rules 返回该限流器当前配置的所有规则，顺序与New/AddRule调用顺序一致
+func (this *Visitercontrol) Rules() []Rule {
+	return append([]Rule(nil), this.rules...)
+}
+
+//NextResetAt 返回该访客何时能重新获得访问权限：
+//取所有已经达到上限的规则中，队头(最早一条还未过期的访问记录)过期时间最晚的那个，
+//即所有规则都重新放行所需等待到的时刻；如果当前没有任何规则被占满，则返回零值time.Time。
+//判断"是否被占满"时用ValidSize(now)而不是IsFull()，理由和remaining()一致：
+//队列里可能堆着已经过期、但还没被deleteExpiredOnce清理掉的记录，IsFull()会把这种情况也误判为占满，
+//从而返回一个早已过去的、没有意义的时间，与RemainingVisits的判断互相矛盾。
+//ValidSize(now)等于maxVisitsNum时，说明队列里每一条记录都还没过期，此时队头Peek()出来的值才是准确的
+func (this *Visitercontrol) NextResetAt(key interface{}) time.Time {
+	s := this.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, exist := s.records[key]
+	if !exist {
+		return time.Time{}
+	}
+	now := time.Now().UnixNano()
+	var latest int64
+	for i, q := range record.queues {
+		if q.ValidSize(now) < this.rules[i].maxVisitsNum {
+			continue
+		}
+		if head, err := q.Peek(); err == nil && head > latest {
+			latest = head
+		}
+	}
+	if latest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, latest)
+}
+
 //增加一条访问记录
 func (this *Visitercontrol) add(key interface{}) (err error) {
-	index, exist := this.indexes.Load(key)
-	//存在某访客，则在该访客记录中增加一条访问记录
-	if exist {
-		return this.visitorRecords[index.(int)].Push(time.Now().Add(this.defaultExpiration).UnixNano())
-	} else {
-		//不存在该访客记录的时候
-		this.lock.RLock()
-		defer this.lock.RUnlock()
-		//有未使用的缓存时
-		if this.notUsedVisitorRecordsIndex.Size() > 0 {
-			for index := range this.notUsedVisitorRecordsIndex.Items {
-				this.visitorRecords[index].Push(time.Now().Add(this.defaultExpiration).UnixNano())
-				this.notUsedVisitorRecordsIndex.Remove(index)
-				//下标索引位置
-				this.indexes.Store(key, index)
-				break
-			}
+	s := this.shardFor(key)
+
+	s.mu.RLock()
+	_, exist := s.records[key]
+	s.mu.RUnlock()
+	//只有将要新增一个key时才需要为它预留名额，这一步不持有s.mu，
+	//避免在淘汰过程中需要依次尝试其它分片时，与另一个分片上同时进行的淘汰互相持锁等待造成死锁。
+	//reserveSlot内部用CAS循环保证"判断是否超限"与"占用一个名额"是原子的一个整体，
+	//不会出现多个协程都看到keyCount<maxKeys从而一起挤进来，导致总数超过maxKeys
+	reserved := false
+	if !exist {
+		reserved = this.reserveSlot(s)
+	}
 
-		} else {
-			//没有缓存可使用时
-			queue := newCircleQueueInt64(this.maxVisitsNum)
-			queue.Push(time.Now().Add(this.defaultExpiration).UnixNano())
-			this.visitorRecords = append(this.visitorRecords, queue)
-			//最后一条数据是下标索引位置
-			this.indexes.Store(key, len(this.visitorRecords)-1)
+	s.mu.Lock()
+	record, exist := s.records[key]
+	if !exist {
+		record = newVisitorRecord(this.rules)
+		s.records[key] = record
+		if !reserved {
+			atomic.AddInt64(&this.keyCount, 1)
 		}
+	} else if reserved {
+		//预留名额期间该key已经被其它协程创建，这个名额没有用上，归还
+		atomic.AddInt64(&this.keyCount, -1)
+	}
+	s.touch(key)
+	allowed := record.allow(this.rules)
+	s.mu.Unlock()
+
+	if allowed {
 		return nil
 	}
+	return errors.New("queue is full")
+}
+
+//reserveSlot 为即将新增的一个key预留名额，返回是否真正完成了预留(预留成功时keyCount已经+1，
+//调用方若最终发现名额没有用上，需要自行把keyCount归还)。
+//maxKeys<=0表示不限制数量，无需预留，直接返回false。
+//用CAS循环而不是"读keyCount→判断→+1"这种分两步走的写法，是为了避免多个协程都在判断时看到
+//keyCount还没到maxKeys，于是一起把key加了进来，导致keyCount最终远超过maxKeys；
+//单纯因为CAS竞争失败(被其它协程同时改动)而重试不设上限，因为每次失败都意味着别的协程刚好
+//成功挪动了一次keyCount，整体必然在有限次重试后收敛。
+//真正设置上限的是"腾出空间"这一步的重试次数：正常情况下每腾出一个名额就足够预留成功，
+//高并发下某个协程运气不好、被反复抢先也有可能需要更多次才能轮到自己，所以这个上限留得足够宽松；
+//之所以还要设置上限(而不是无限重试)，是为了防止OnEvicted回调里又反过来调用了AllowVisit、
+//把刚腾出的名额立刻占用掉，导致这里不停地腾位置却总也轮不到自己，陷入死循环
+func (this *Visitercontrol) reserveSlot(preferred *shard) bool {
+	maxKeys := atomic.LoadInt64(&this.maxKeys)
+	if maxKeys <= 0 {
+		return false
+	}
+	evictAttempts := 0
+	const maxEvictAttempts = 1 << 16
+	for {
+		current := atomic.LoadInt64(&this.keyCount)
+		if current < maxKeys {
+			if atomic.CompareAndSwapInt64(&this.keyCount, current, current+1) {
+				return true
+			}
+			continue
+		}
+		if evictAttempts >= maxEvictAttempts {
+			return false
+		}
+		evictAttempts++
+		//已经达到上限，腾出一个名额后重新尝试预留
+		if !this.evictForSpace(preferred) {
+			//没有任何key可供淘汰，放弃预留
+			return false
+		}
+	}
+}
+
+//evictForSpace 为了给新key腾出空间，淘汰一个key，优先从preferred分片里淘汰，
+//只有preferred分片恰好没有可淘汰的key(例如maxKeys远小于分片数量，大部分分片都是空的)时，才会依次尝试其它分片。
+//返回是否成功淘汰了一个key
+func (this *Visitercontrol) evictForSpace(preferred *shard) bool {
+	if this.evictOldest(preferred) {
+		return true
+	}
+	for _, s := range this.shards {
+		if s == preferred {
+			continue
+		}
+		if this.evictOldest(s) {
+			return true
+		}
+	}
+	return false
+}
+
+//evictOldest 淘汰分片s中最久未被访问的key(LRU)，整个淘汰过程只持有s一个分片的锁，
+//onEvicted回调在锁释放之后才会被调用，因此允许回调里再次访问该Visitercontrol而不会死锁
+func (this *Visitercontrol) evictOldest(s *shard) bool {
+	s.mu.Lock()
+	oldest := s.order.Back()
+	if oldest == nil {
+		s.mu.Unlock()
+		return false
+	}
+	key := oldest.Value
+	delete(s.records, key)
+	s.forget(key)
+	s.mu.Unlock()
+
+	atomic.AddInt64(&this.keyCount, -1)
+	if this.onEvicted != nil {
+		this.onEvicted(key)
+	}
+	return true
 }
 
 //删除过期数据
@@ -108,32 +291,26 @@ func (this *Visitercontrol) deleteExpired() {
 		if finished {
 			finished = false
 			this.deleteExpiredOnce()
-			this.gc()
 			finished = true
 		}
 	}
 }
 
-//在特定时间间隔内执行一次删除过期数据操作
+//在特定时间间隔内执行一次删除过期数据操作，每次只冻结一个分片，不影响其它分片的读写
 func (this *Visitercontrol) deleteExpiredOnce() {
-	this.indexes.Range(func(k, v interface{}) bool {
-		index := v.(int)
-		//防止越界出错，理论上不存在这种情况
-		if index < len(this.visitorRecords) && index >= 0 {
-			this.visitorRecords[index].DeleteExpired()
-			//某用户某段时间无访问记录时，删除该用户，并把剩余的空访问记录加入缓存记录池
-			if this.visitorRecords[index].Size() == 0 {
-				this.lock.Lock()
-				defer this.lock.Unlock()
-				this.indexes.Delete(k)
-				this.notUsedVisitorRecordsIndex.Add(index)
+	for _, s := range this.shards {
+		s.mu.Lock()
+		for k, record := range s.records {
+			record.deleteExpired()
+			//某用户某段时间无访问记录时，直接从map中删除，交还内存
+			if record.isEmpty() {
+				delete(s.records, k)
+				s.forget(k)
+				atomic.AddInt64(&this.keyCount, -1)
 			}
-		} else {
-			this.indexes.Delete(k)
 		}
-
-		return true
-	})
+		s.mu.Unlock()
+	}
 }
 
 //把Int64转换成IP4的的字符串形式
@@ -145,61 +322,3 @@ func (this *Visitercontrol) Int64ToIp4String(ip int64) string {
 func (this *Visitercontrol) Ip4StringToInt64(ip string) int64 {
 	return Ip4StringToInt64(ip)
 }
-
-//出现峰值之后，回收访问数据，减少内存占用
-func (this *Visitercontrol) gc() {
-	this.lock.Lock()
-	defer this.lock.Unlock()
-	if this.needGc() {
-		curLen := len(this.visitorRecords)
-		unUsedLen := len(this.notUsedVisitorRecordsIndex.Items)
-		usedLen := curLen - unUsedLen
-		var newLen int
-		if usedLen < this.maximumNumberOfOnlineUsers {
-			newLen = this.maximumNumberOfOnlineUsers
-		} else {
-			newLen = usedLen * 2
-		}
-		//建立新缓存
-		visitorRecordsNew := make([]*circleQueueInt64, newLen)
-		for i := range visitorRecordsNew {
-			visitorRecordsNew[i] = newCircleQueueInt64(this.maxVisitsNum)
-		}
-		//清空未使用索引
-		this.notUsedVisitorRecordsIndex.Clear()
-		//重建索引
-		indexNew := 0
-		this.indexes.Range(func(k, v interface{}) bool {
-			indexOld := v.(int)
-			visitorRecordsNew[indexNew] = this.visitorRecords[indexOld]
-			indexNew++
-			return true
-		})
-		this.visitorRecords = visitorRecordsNew
-		//重建未使用索引
-		for i := range this.visitorRecords {
-			if i >= indexNew {
-				this.notUsedVisitorRecordsIndex.Add(i)
-			}
-		}
-	}
-}
-
-//是否需要对visitorRecords进行清理
-//如果visitorRecords数据空的太多,则需要进行清理操作
-//并且长度远大于默认在线用户数量，则需要进行GC操作
-func (this *Visitercontrol) needGc() bool {
-	curLen := len(this.visitorRecords)
-	unUsedLen := len(this.notUsedVisitorRecordsIndex.Items)
-	usedLen := curLen - unUsedLen
-	//log.Println("总:", curLen, "已用:", usedLen, "未使用:", unUsedLen)
-	//比预期的少，我们就不回收了
-	if curLen < 2*this.maximumNumberOfOnlineUsers {
-		return false
-	}
-	//未使用的太多，则需要回收
-	if usedLen*2 < unUsedLen {
-		return true
-	}
-	return false
-}